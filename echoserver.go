@@ -1,49 +1,324 @@
 package main
 
+//go:generate go run openapi_gen.go
+
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
 	"log"
-	"math/rand"
+	"math"
+	mathrand "math/rand"
+	"net"
 	"net/http"
-	"net/http/httputil"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
-	listenAddress = ":8080"
+	listenAddress          = ":8080"
+	loremIpsum             = "Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod tempor incididunt ut labore et dolore magna aliqua. "
+	multipartMaxSize       = 32 << 20
+	multipartMaxValueSize  = 256
+	longpollMaxBodySize    = 1 << 20
+	fingerprintMaxBodySize = 32 << 20
+	streamMaxSize          = 1 << 20
+
+	// longpollWriteTimeoutMargin is the time between the end of the long-poll
+	// timeout and the write timeout of the server, which is left for writing
+	// the response.
+	longpollWriteTimeoutMargin = time.Second
+)
+
+var (
+	//go:embed openapi.json
+	openapiJSON []byte
+	//go:embed openapi.yaml
+	openapiYAML []byte
 )
 
 var (
 	randomStatusCodes = []int{200, 200, 200, 200, 200, 400, 500, 502, 503}
+	pushedResources   = []string{"/health", "/openapi.json"}
+	goroutineRegexp   = regexp.MustCompile(`^goroutine (\d+) \[([^\]]*)\]:`)
+	headerNameRegexp  = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9A-Za-z]+$")
+	envRedactedNames  = []string{"STATUS_OVERRIDE_TOKEN", "BEARER_TOKENS", "MIRROR_URL"}
+	hopByHopHeaders   = []string{"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade"}
 )
 
-func main() {
-	router := http.NewServeMux()
+const pngKeyword = "Comment\x00"
 
-	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+var (
+	// pngImage is a 1x1 PNG image, which is padded by writePNG. The smallest
+	// padded image contains an additional tEXt chunk with an empty comment.
+	pngImage = func() []byte {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+			panic(err)
+		}
+		return buf.Bytes()
+	}()
+	pngMinSize = len(pngImage) + 12 + len(pngKeyword)
+	// The length of a PNG chunk must not exceed 2^31-1 bytes.
+	pngMaxSize = pngMinSize - len(pngKeyword) + math.MaxInt32
+)
 
-		dump, err := httputil.DumpRequest(r, true)
-		if err != nil {
-			http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
-			return
+// getEnvDuration returns the duration from the environment variable with the
+// given key or the fallback value when the environment variable is not set.
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid value for %s: %s", key, err.Error())
+	}
+
+	return duration
+}
+
+// getEnvInt returns the integer from the environment variable with the given
+// key or the fallback value when the environment variable is not set.
+func getEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid value for %s: %s", key, err.Error())
+	}
+
+	return i
+}
+
+// splitList splits the given comma-separated list. Whitespace around the
+// items is removed and empty items are ignored.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
 		}
+	}
 
-		fmt.Fprintf(w, "%s", string(dump))
-	})
+	return items
+}
 
-	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "OK")
-	})
+// handleIf registers the handler for the given pattern, when enabled is true.
+// Otherwise a 404 status code is returned for the pattern, so that the requests
+// are not handled by the echo handler.
+func handleIf(router *http.ServeMux, pattern string, enabled bool, handler http.HandlerFunc) {
+	if !enabled {
+		router.HandleFunc(pattern, http.NotFound)
+		return
+	}
+
+	router.HandleFunc(pattern, handler)
+}
+
+// listenUnix listens on the given unix socket, which can only be used by the
+// owner and the group. A socket file, which was left by a previous run that
+// was not shut down gracefully, is removed before.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(path, 0660); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// gracefulShutdown waits for the drain delay before the server is shut down, so
+// that load balancers have enough time to remove the server from their
+// endpoints. During this time requests are still served, but the health
+// endpoint returns a 503 status code. Afterwards the server is shut down and
+// active requests can take up to the shutdown timeout to complete.
+func gracefulShutdown(server *http.Server, draining *atomic.Bool, drainDelay, shutdownTimeout time.Duration) error {
+	if drainDelay > 0 {
+		draining.Store(true)
+		log.Printf("Wait %s before the server is shut down", drainDelay)
+		time.Sleep(drainDelay)
+	}
+
+	log.Printf("Shutdown server...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	return server.Shutdown(ctx)
+}
+
+// writeRepeated writes the given pattern to w until size bytes are written.
+// The last pattern is truncated if necessary.
+func writeRepeated(w io.Writer, pattern string, size int) error {
+	chunk := []byte(strings.Repeat(pattern, max(1, (32<<10)/len(pattern))))
+
+	for size > 0 {
+		n := min(size, len(chunk))
+		if _, err := w.Write(chunk[:n]); err != nil {
+			return err
+		}
+		size -= n
+	}
+
+	return nil
+}
+
+// writePNG writes a valid 1x1 PNG image with the given size to w. The image is
+// padded to the size via a tEXt chunk, which is inserted before the IEND chunk
+// and streamed via writeRepeated. If the size is too small or too large for
+// such an image an error is returned before anything is written.
+func writePNG(w io.Writer, size int) error {
+	padding := size - pngMinSize
+	if padding < 0 || size > pngMaxSize {
+		return fmt.Errorf("size must be between %d and %d bytes for a png image", pngMinSize, pngMaxSize)
+	}
+
+	header, iend := pngImage[:len(pngImage)-12], pngImage[len(pngImage)-12:]
+	chunkType := []byte("tEXt" + pngKeyword)
+
+	chunkLength := make([]byte, 4)
+	binary.BigEndian.PutUint32(chunkLength, uint32(len(pngKeyword)+padding))
+
+	crc := crc32.NewIEEE()
+	crc.Write(chunkType)
+
+	for _, b := range [][]byte{header, chunkLength, chunkType} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	if err := writeRepeated(io.MultiWriter(w, crc), " ", padding); err != nil {
+		return err
+	}
+	if _, err := w.Write(crc.Sum(nil)); err != nil {
+		return err
+	}
+	_, err := w.Write(iend)
+	return err
+}
+
+// percentile is the latency for a quantile of the latency distribution
+// simulated by the "/p99" endpoint.
+type percentile struct {
+	name     string
+	quantile float64
+	latency  time.Duration
+}
+
+// interpolateLatency returns the latency for the given quantile. The latency is
+// interpolated linearly between the two surrounding percentiles, which must be
+// in ascending order. Quantiles below the first percentile are interpolated
+// from 0 and quantiles above the last percentile use the last percentile.
+func interpolateLatency(percentiles []percentile, quantile float64) time.Duration {
+	prevQuantile, prevLatency := 0.0, time.Duration(0)
+	for _, p := range percentiles {
+		if quantile <= p.quantile {
+			return prevLatency + time.Duration((quantile-prevQuantile)/(p.quantile-prevQuantile)*float64(p.latency-prevLatency))
+		}
+		prevQuantile, prevLatency = p.quantile, p.latency
+	}
+
+	return prevLatency
+}
+
+// goroutine is a single goroutine parsed from the output of runtime.Stack.
+type goroutine struct {
+	ID       int    `json:"id"`
+	State    string `json:"state"`
+	Function string `json:"function"`
+	Stack    string `json:"stack"`
+}
+
+// goroutineDump returns the stacks of all goroutines in the format of
+// runtime.Stack.
+func goroutineDump() string {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// goroutines returns the parsed stacks of all goroutines.
+func goroutines() []goroutine {
+	var result []goroutine
+	for _, block := range strings.Split(strings.TrimSpace(goroutineDump()), "\n\n") {
+		header, stack, _ := strings.Cut(block, "\n")
+
+		matches := goroutineRegexp.FindStringSubmatch(header)
+		if matches == nil {
+			continue
+		}
+		id, _ := strconv.Atoi(matches[1])
+
+		function, _, _ := strings.Cut(stack, "\n")
+		if i := strings.LastIndex(function, "("); i > 0 {
+			function = function[:i]
+		}
+
+		result = append(result, goroutine{ID: id, State: matches[2], Function: function, Stack: stack})
+	}
+
+	return result
+}
+
+func main() {
+	var draining atomic.Bool
+
+	// The shutdown channel is closed when the server is shut down, so that
+	// long running handlers can return before the shutdown timeout expires.
+	shutdown := make(chan struct{})
+
+	// The WriteTimeout also limits the time a handler can take to respond, so
+	// it must be higher than the longest timeout used via the "/timeout"
+	// endpoint. The timeout of the "/longpoll" endpoint is capped by it.
+	writeTimeout := getEnvDuration("WRITE_TIMEOUT", 30*time.Second)
+
+	router := http.NewServeMux()
+
+	router.HandleFunc("/", echoHandler)
+
+	router.HandleFunc("/health", healthHandler(&draining))
 
 	router.HandleFunc("/status", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
 
 		statusString := r.URL.Query().Get("status")
 		if statusString == "" || statusString == "random" {
-			index := rand.Intn(len(randomStatusCodes))
+			index := mathrand.Intn(len(randomStatusCodes))
 			w.WriteHeader(randomStatusCodes[index])
 			return
 		}
@@ -57,52 +332,229 @@ func main() {
 		w.WriteHeader(status)
 	}))
 
-	router.HandleFunc("/timeout", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/timeout", timeoutHandler(shutdown))
+
+	router.HandleFunc("/headersize", func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
 
-		timeoutString := r.URL.Query().Get("timeout")
-		if timeoutString == "" {
-			http.Error(w, "timout parameter is missing", http.StatusBadRequest)
+		headerSizeString := r.URL.Query().Get("size")
+		if headerSizeString == "" {
+			http.Error(w, "size parameter is missing", http.StatusBadRequest)
 			return
 		}
 
-		timeout, err := time.ParseDuration(timeoutString)
+		size, err := strconv.Atoi(headerSizeString)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		time.Sleep(timeout)
+		w.Header().Add("X-Header-Size", strings.Repeat("0", size))
 		w.WriteHeader(200)
 	})
 
-	router.HandleFunc("/headersize", func(w http.ResponseWriter, r *http.Request) {
+	router.HandleFunc("/bodysize", bodySizeHandler)
+
+	router.HandleFunc("/stream", streamHandler(shutdown))
+
+	router.HandleFunc("/redirect", redirectHandler)
+
+	router.HandleFunc("/push", func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
 
-		headerSizeString := r.URL.Query().Get("size")
-		if headerSizeString == "" {
-			http.Error(w, "size parameter is missing", http.StatusBadRequest)
-			return
+		// The server only speaks HTTP/1.1, so the resources can not be pushed.
+		// Instead we return a Link header for each resource, so that the
+		// client can preload them.
+		for _, resource := range pushedResources {
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=preload", resource))
 		}
 
-		size, err := strconv.Atoi(headerSizeString)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		fmt.Fprintf(w, "OK")
+	})
+
+	router.HandleFunc("/fingerprint", fingerprintHandler)
+
+	router.HandleFunc("/multipart", multipartHandler)
+
+	router.HandleFunc("/trailer", trailerHandler)
+
+	router.HandleFunc("/hijack", hijackHandler)
+
+	router.HandleFunc("/p99", func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+		percentiles := []percentile{
+			{name: "p50", quantile: 0.5, latency: 10 * time.Millisecond},
+			{name: "p90", quantile: 0.9, latency: 50 * time.Millisecond},
+			{name: "p99", quantile: 0.99, latency: 200 * time.Millisecond},
+			{name: "p999", quantile: 0.999, latency: 2 * time.Second},
 		}
 
-		w.Header().Add("X-Header-Size", strings.Repeat("0", size))
-		w.WriteHeader(200)
+		for i := range percentiles {
+			if latencyString := r.URL.Query().Get(percentiles[i].name); latencyString != "" {
+				latency, err := time.ParseDuration(latencyString)
+				if err != nil || latency < 0 {
+					http.Error(w, fmt.Sprintf("invalid %s parameter", percentiles[i].name), http.StatusBadRequest)
+					return
+				}
+				percentiles[i].latency = latency
+			}
+
+			if i > 0 && percentiles[i].latency < percentiles[i-1].latency {
+				http.Error(w, "percentiles must be in ascending order", http.StatusBadRequest)
+				return
+			}
+		}
+
+		// Choose a random quantile and interpolate the latency for it.
+		var b [8]byte
+		rand.Read(b[:])
+		latency := interpolateLatency(percentiles, float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53))
+
+		w.Header().Set("X-Simulated-Latency", latency.String())
+
+		select {
+		case <-time.After(latency):
+			w.WriteHeader(200)
+		case <-shutdown:
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		case <-r.Context().Done():
+			http.Error(w, r.Context().Err().Error(), http.StatusRequestTimeout)
+		}
 	})
 
+	handleIf(router, "/debug/goroutines", os.Getenv("ENABLE_DEBUG_GOROUTINES") == "true", goroutinesHandler)
+
+	broker := newLongpollBroker()
+
+	router.HandleFunc("/longpoll", longpollHandler(broker, shutdown, writeTimeout))
+
+	router.HandleFunc("/longpoll/publish", longpollPublishHandler(broker))
+
+	router.HandleFunc("/openapi.json", openapiHandler("application/json", openapiJSON))
+
+	router.HandleFunc("/openapi.yaml", openapiHandler("application/yaml", openapiYAML))
+
+	handleIf(router, "/env", os.Getenv("ENABLE_ENV_HANDLER") == "true", envHandler)
+
+	var recordings *recordingStore
+	if os.Getenv("ENABLE_RECORDINGS") == "true" {
+		maxEntries := getEnvInt("RECORDINGS_MAX_ENTRIES", 50)
+		if maxEntries <= 0 {
+			log.Fatalf("Invalid value for RECORDINGS_MAX_ENTRIES: must be greater than 0")
+		}
+
+		recordings = newRecordingStore(maxEntries)
+	}
+	handleIf(router, "/debug/recordings", recordings != nil, recordingsHandler(recordings))
+
+	var handler http.Handler = router
+	if token := os.Getenv("STATUS_OVERRIDE_TOKEN"); token != "" {
+		handler = statusOverride(token)(handler)
+	}
+	if mirrorURL := os.Getenv("MIRROR_URL"); mirrorURL != "" {
+		handler = mirror(mirrorURL)(handler)
+	}
+	if recordings != nil {
+		handler = record(recordings)(handler)
+	}
+	if os.Getenv("ENABLE_IDEMPOTENCY") == "true" {
+		maxKeys := getEnvInt("IDEMPOTENCY_MAX_KEYS", 1000)
+		if maxKeys <= 0 {
+			log.Fatalf("Invalid value for IDEMPOTENCY_MAX_KEYS: must be greater than 0")
+		}
+
+		ttl := getEnvDuration("IDEMPOTENCY_TTL", 24*time.Hour)
+		if ttl <= 0 {
+			log.Fatalf("Invalid value for IDEMPOTENCY_TTL: must be greater than 0")
+		}
+
+		handler = idempotency(newIdempotencyCache(ttl, maxKeys))(handler)
+	}
+	handler = deadline(handler)
+	handler = auditLog(handler)
+	handler = methodOverride(handler)
+	if maxHeaderCount, maxHeaderValueBytes := getEnvInt("MAX_HEADER_COUNT", 0), getEnvInt("MAX_HEADER_VALUE_BYTES", 0); maxHeaderCount > 0 || maxHeaderValueBytes > 0 {
+		handler = headerLimit(maxHeaderCount, maxHeaderValueBytes)(handler)
+	}
+	if bearerTokens := os.Getenv("BEARER_TOKENS"); bearerTokens != "" {
+		exemptPaths := []string{"/health"}
+		if paths, ok := os.LookupEnv("BEARER_EXEMPT_PATHS"); ok {
+			exemptPaths = splitList(paths)
+		}
+
+		tokens := splitList(bearerTokens)
+		if len(tokens) == 0 {
+			log.Fatalf("Invalid value for BEARER_TOKENS: must contain at least one token")
+		}
+
+		handler = bearerAuth(tokens, exemptPaths)(handler)
+	}
+	handler = correlationID(handler)
+
 	server := &http.Server{
-		Addr:    listenAddress,
-		Handler: router,
+		Addr:         listenAddress,
+		Handler:      handler,
+		ReadTimeout:  getEnvDuration("READ_TIMEOUT", 30*time.Second),
+		WriteTimeout: writeTimeout,
+		IdleTimeout:  getEnvDuration("IDLE_TIMEOUT", 120*time.Second),
 	}
+	server.RegisterOnShutdown(func() {
+		close(shutdown)
+	})
 
-	log.Printf("Server listen on: %s", listenAddress)
+	shutdownTimeout := getEnvDuration("SHUTDOWN_TIMEOUT", 10*time.Second)
+	drainDelay := getEnvDuration("DRAIN_DELAY", 0)
+	unixSocket := os.Getenv("UNIX_SOCKET")
+
+	go func() {
+		if unixSocket != "" {
+			listener, err := listenUnix(unixSocket)
+			if err != nil {
+				log.Fatalf("Could not listen on unix socket: %s", err.Error())
+			}
+
+			log.Printf("Server listen on: %s", unixSocket)
+
+			if err := server.Serve(listener); err != http.ErrServerClosed {
+				log.Fatalf("HTTP server died unexpected: %s", err.Error())
+			}
+			return
+		}
 
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatalf("HTTP server died unexpected: %s", err.Error())
+		log.Printf("Server listen on: %s", listenAddress)
+
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("HTTP server died unexpected: %s", err.Error())
+		}
+	}()
+
+	// When enabled, the stacks of all goroutines are written to the log on a
+	// SIGQUIT signal instead of exiting the process.
+	if os.Getenv("SIGQUIT_DUMP") == "true" {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, syscall.SIGQUIT)
+
+		go func() {
+			for range quit {
+				log.Printf("Goroutine dump:\n%s", goroutineDump())
+			}
+		}()
+	}
+
+	done := make(chan os.Signal, 1)
+	signal.Notify(done, syscall.SIGINT, syscall.SIGTERM)
+	<-done
+
+	// The error is only logged, so that the unix socket is still removed when
+	// the graceful shutdown fails.
+	if err := gracefulShutdown(server, &draining, drainDelay, shutdownTimeout); err != nil {
+		log.Printf("Graceful shutdown failed: %s", err.Error())
+	}
+
+	if unixSocket != "" {
+		if err := os.Remove(unixSocket); err != nil && !os.IsNotExist(err) {
+			log.Printf("Could not remove unix socket: %s", err.Error())
+		}
 	}
 }
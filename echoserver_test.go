@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/png"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSplitList(t *testing.T) {
+	for _, tc := range []struct {
+		value    string
+		expected []string
+	}{
+		{value: "", expected: nil},
+		{value: " , ,", expected: nil},
+		{value: "/health", expected: []string{"/health"}},
+		{value: "/health, /metrics ,,/ready", expected: []string{"/health", "/metrics", "/ready"}},
+	} {
+		t.Run(tc.value, func(t *testing.T) {
+			if items := splitList(tc.value); !slices.Equal(items, tc.expected) {
+				t.Errorf("expected %q, got %q", tc.expected, items)
+			}
+		})
+	}
+}
+
+func TestWritePNG(t *testing.T) {
+	for _, tc := range []struct {
+		size          int
+		expectedError bool
+	}{
+		{size: 0, expectedError: true},
+		{size: pngMinSize - 1, expectedError: true},
+		{size: pngMinSize},
+		{size: pngMinSize + 1},
+		{size: 1 << 20},
+		{size: pngMaxSize + 1, expectedError: true},
+	} {
+		t.Run(strconv.Itoa(tc.size), func(t *testing.T) {
+			var buf bytes.Buffer
+			err := writePNG(&buf, tc.size)
+
+			if tc.expectedError {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				if buf.Len() != 0 {
+					t.Errorf("expected nothing to be written, got %d bytes", buf.Len())
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("expected no error, got %s", err.Error())
+			}
+			if buf.Len() != tc.size {
+				t.Errorf("expected size %d, got %d", tc.size, buf.Len())
+			}
+
+			img, err := png.Decode(&buf)
+			if err != nil {
+				t.Fatalf("expected valid png image, got error: %s", err.Error())
+			}
+			if bounds := img.Bounds(); bounds.Dx() != 1 || bounds.Dy() != 1 {
+				t.Errorf("expected 1x1 image, got %dx%d", bounds.Dx(), bounds.Dy())
+			}
+		})
+	}
+}
+
+func TestInterpolateLatency(t *testing.T) {
+	percentiles := []percentile{
+		{name: "p50", quantile: 0.5, latency: 10 * time.Millisecond},
+		{name: "p90", quantile: 0.9, latency: 50 * time.Millisecond},
+		{name: "p99", quantile: 0.99, latency: 200 * time.Millisecond},
+		{name: "p999", quantile: 0.999, latency: 2 * time.Second},
+	}
+
+	for _, tc := range []struct {
+		quantile float64
+		expected time.Duration
+	}{
+		{quantile: 0, expected: 0},
+		{quantile: 0.25, expected: 5 * time.Millisecond},
+		{quantile: 0.5, expected: 10 * time.Millisecond},
+		{quantile: 0.7, expected: 30 * time.Millisecond},
+		{quantile: 0.9, expected: 50 * time.Millisecond},
+		{quantile: 0.945, expected: 125 * time.Millisecond},
+		{quantile: 0.99, expected: 200 * time.Millisecond},
+		{quantile: 0.9945, expected: 1100 * time.Millisecond},
+		{quantile: 0.999, expected: 2 * time.Second},
+		{quantile: 0.9999, expected: 2 * time.Second},
+	} {
+		t.Run(strconv.FormatFloat(tc.quantile, 'f', -1, 64), func(t *testing.T) {
+			latency := interpolateLatency(percentiles, tc.quantile)
+
+			// The interpolation uses floating point numbers, so we allow a
+			// small deviation from the expected latency.
+			if diff := latency - tc.expected; diff < -time.Microsecond || diff > time.Microsecond {
+				t.Errorf("expected latency %s, got %s", tc.expected, latency)
+			}
+		})
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "echoserver.sock")
+
+	// Simulate a socket file, which was left by a previous run that was killed.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("could not create stale socket: %s", err.Error())
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listenUnix(path)
+	if err != nil {
+		t.Fatalf("could not listen on unix socket: %s", err.Error())
+	}
+
+	if info, err := os.Stat(path); err != nil {
+		t.Fatalf("could not stat unix socket: %s", err.Error())
+	} else if perm := info.Mode().Perm(); perm != 0660 {
+		t.Errorf("expected permissions 0660, got %o", perm)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})}
+	go server.Serve(listener)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+
+	resp, err := client.Get("http://unix/")
+	if err != nil {
+		t.Fatalf("could not send request over unix socket: %s", err.Error())
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "OK" {
+		t.Errorf("expected status code 200 and body OK, got %d and %q", resp.StatusCode, body)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatalf("could not shut down server: %s", err.Error())
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected unix socket to be removed after shutdown, got %v", err)
+	}
+}
+
+func TestListenUnixNoSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "echoserver.sock")
+	if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatalf("could not create file: %s", err.Error())
+	}
+
+	if _, err := listenUnix(path); err == nil {
+		t.Fatal("expected error, when the path is not a socket")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("expected file, which is not a socket, not to be removed: %s", err.Error())
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	var draining atomic.Bool
+	shutdown := make(chan struct{})
+
+	router := http.NewServeMux()
+	router.HandleFunc("/health", healthHandler(&draining))
+	router.HandleFunc("/timeout", timeoutHandler(shutdown))
+
+	server := &http.Server{Handler: router}
+	server.RegisterOnShutdown(func() {
+		close(shutdown)
+	})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err.Error())
+	}
+	go server.Serve(listener)
+
+	url := "http://" + listener.Addr().String()
+	get := func(path string) int {
+		resp, err := http.Get(url + path)
+		if err != nil {
+			t.Errorf("could not send request to %s: %s", path, err.Error())
+			return 0
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode
+	}
+
+	if status := get("/health"); status != http.StatusOK {
+		t.Fatalf("expected status code 200 before shutdown, got %d", status)
+	}
+
+	// A pending request to the timeout endpoint must not delay the shutdown
+	// until the shutdown timeout is exceeded.
+	pending := make(chan int)
+	go func() {
+		pending <- get("/timeout?timeout=25s")
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	const drainDelay = 200 * time.Millisecond
+	start := time.Now()
+	result := make(chan error)
+	go func() {
+		result <- gracefulShutdown(server, &draining, drainDelay, time.Second)
+	}()
+
+	// During the drain delay requests are still served, but the health
+	// endpoint returns a 503 status code.
+	time.Sleep(drainDelay / 4)
+	if status := get("/health"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected status code 503 while draining, got %d", status)
+	}
+	if status := get("/timeout?timeout=1ms"); status != http.StatusOK {
+		t.Errorf("expected status code 200 while draining, got %d", status)
+	}
+
+	if err := <-result; err != nil {
+		t.Errorf("expected graceful shutdown, got error: %s", err.Error())
+	}
+	if duration := time.Since(start); duration < drainDelay || duration > drainDelay+500*time.Millisecond {
+		t.Errorf("expected shutdown to take the drain delay of %s, took %s", drainDelay, duration)
+	}
+	if status := <-pending; status != http.StatusServiceUnavailable {
+		t.Errorf("expected status code 503 for the pending request, got %d", status)
+	}
+}
+
+func TestGoroutineDump(t *testing.T) {
+	// Start enough goroutines, so that the dump is larger than the initial
+	// buffer of 64KB and the buffer must be grown.
+	stop := make(chan struct{})
+	defer close(stop)
+
+	const blocked = 1000
+	var started sync.WaitGroup
+	started.Add(blocked)
+	for i := 0; i < blocked; i++ {
+		go func() {
+			started.Done()
+			<-stop
+		}()
+	}
+	started.Wait()
+
+	dump := goroutineDump()
+
+	if len(dump) <= 64<<10 {
+		t.Fatalf("expected dump larger than 64KB, got %d bytes", len(dump))
+	}
+	if !strings.HasPrefix(dump, "goroutine ") {
+		t.Errorf("expected dump to start with a goroutine header, got %q", dump[:min(len(dump), 100)])
+	}
+	if !strings.Contains(dump, "TestGoroutineDump") {
+		t.Errorf("expected dump to contain the stack of the test")
+	}
+
+	headers := 0
+	for _, block := range strings.Split(strings.TrimSpace(dump), "\n\n") {
+		if !goroutineRegexp.MatchString(block) {
+			t.Fatalf("expected each block to start with a goroutine header, got %q", block)
+		}
+		headers++
+	}
+	if headers < blocked {
+		t.Errorf("expected at least %d goroutines, got %d", blocked, headers)
+	}
+}
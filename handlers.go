@@ -0,0 +1,623 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// bodySizeHandler returns a body of the size and type defined via the "size"
+// and "type" query parameters.
+func bodySizeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+	bodySizeString := r.URL.Query().Get("size")
+	if bodySizeString == "" {
+		http.Error(w, "size parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	size, err := strconv.Atoi(bodySizeString)
+	if err != nil || size < 0 {
+		http.Error(w, "invalid size parameter", http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Query().Get("type") {
+	case "", "binary":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		writeRepeated(w, "\x00", size)
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		writeRepeated(w, loremIpsum, size)
+	case "json":
+		// The JSON array is filled with objects, until the remaining size
+		// is smaller than an object. The remaining size is filled with
+		// whitespace before the closing bracket.
+		const object = `{"value":null}`
+		if size < 2 {
+			http.Error(w, "size must be at least 2 bytes for json", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+
+		objects := 0
+		if size >= 2+len(object) {
+			objects = (size - 2 + 1) / (len(object) + 1)
+		}
+
+		w.Write([]byte("["))
+		if objects > 0 {
+			w.Write([]byte(object))
+			writeRepeated(w, ","+object, (objects-1)*(len(object)+1))
+		}
+		writeRepeated(w, " ", size-2-max(0, objects*(len(object)+1)-1))
+		w.Write([]byte("]"))
+	case "image/png":
+		if size < pngMinSize || size > pngMaxSize {
+			http.Error(w, fmt.Sprintf("size must be between %d and %d bytes for a png image", pngMinSize, pngMaxSize), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Length", strconv.Itoa(size))
+		writePNG(w, size)
+	default:
+		http.Error(w, "invalid type parameter", http.StatusBadRequest)
+	}
+}
+
+// longpollHandler waits until a message is published to the topic defined via
+// the "topic" query parameter or until the timeout expires. The timeout is
+// capped, so that the response is written before the write timeout of the
+// server expires.
+func longpollHandler(broker *longpollBroker, shutdown <-chan struct{}, writeTimeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+		timeout := 20 * time.Second
+		if timeoutString := r.URL.Query().Get("timeout"); timeoutString != "" {
+			var err error
+			timeout, err = time.ParseDuration(timeoutString)
+			if err != nil || timeout < 0 {
+				http.Error(w, "invalid timeout parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		if writeTimeout > 0 {
+			timeout = min(timeout, max(0, writeTimeout-longpollWriteTimeoutMargin))
+		}
+
+		topic := r.URL.Query().Get("topic")
+		if topic == "" {
+			topic = "default"
+		}
+
+		ch := broker.subscribe(topic)
+		defer broker.unsubscribe(topic, ch)
+
+		select {
+		case message := <-ch:
+			w.Write(message)
+		case <-time.After(timeout):
+			w.WriteHeader(http.StatusNoContent)
+		case <-shutdown:
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		case <-r.Context().Done():
+		}
+	}
+}
+
+// longpollPublishHandler publishes the body of a POST request to all subscribers
+// of the topic defined via the "topic" query parameter.
+func longpollPublishHandler(broker *longpollBroker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		topic := r.URL.Query().Get("topic")
+		if topic == "" {
+			topic = "default"
+		}
+
+		message, err := io.ReadAll(http.MaxBytesReader(w, r.Body, longpollMaxBodySize))
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Subscribers int `json:"subscribers"`
+		}{
+			Subscribers: broker.publish(topic, message),
+		})
+	}
+}
+
+// envHandler returns the environment variables with the prefix defined via the
+// "prefix" query parameter. The values of variables, which contain one of the
+// substrings defined via the "redact" query parameter, and the values of the
+// variables used to configure secrets of the echoserver are redacted.
+func envHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+	type envVar struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	prefix := r.URL.Query().Get("prefix")
+
+	var redact []string
+	if redactString := r.URL.Query().Get("redact"); redactString != "" {
+		redact = strings.Split(strings.ToUpper(redactString), ",")
+	}
+
+	envVars := []envVar{}
+	for _, env := range os.Environ() {
+		name, value, _ := strings.Cut(env, "=")
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		if slices.Contains(envRedactedNames, name) {
+			value = "[REDACTED]"
+		}
+
+		for _, substring := range redact {
+			if substring != "" && strings.Contains(strings.ToUpper(name), substring) {
+				value = "[REDACTED]"
+				break
+			}
+		}
+
+		envVars = append(envVars, envVar{Name: name, Value: value})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(envVars)
+}
+
+// streamHandler streams the number of JSON objects defined via the "chunks"
+// query parameter. Each object contains a random payload with the size defined
+// via the "size" query parameter, which must not be larger than 1MB.
+func streamHandler(shutdown <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+		chunks := 10
+		if chunksString := r.URL.Query().Get("chunks"); chunksString != "" {
+			var err error
+			chunks, err = strconv.Atoi(chunksString)
+			if err != nil || chunks < 0 {
+				http.Error(w, "invalid chunks parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		delay := 100 * time.Millisecond
+		if delayString := r.URL.Query().Get("delay"); delayString != "" {
+			var err error
+			delay, err = time.ParseDuration(delayString)
+			if err != nil || delay < 0 {
+				http.Error(w, "invalid delay parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		size := 512
+		if sizeString := r.URL.Query().Get("size"); sizeString != "" {
+			var err error
+			size, err = strconv.Atoi(sizeString)
+			if err != nil || size < 0 || size > streamMaxSize {
+				http.Error(w, "invalid size parameter", http.StatusBadRequest)
+				return
+			}
+		}
+
+		rc := http.NewResponseController(w)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Transfer-Encoding", "chunked")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.WriteHeader(http.StatusOK)
+
+		payload := make([]byte, base64.StdEncoding.DecodedLen(size)+3)
+		encoder := json.NewEncoder(w)
+
+		for i := 0; i < chunks; i++ {
+			if i > 0 {
+				select {
+				case <-r.Context().Done():
+					return
+				case <-shutdown:
+					return
+				case <-time.After(delay):
+				}
+			}
+
+			rand.Read(payload)
+			if err := encoder.Encode(struct {
+				Sequence  int       `json:"sequence"`
+				Timestamp time.Time `json:"timestamp"`
+				Payload   string    `json:"payload"`
+			}{
+				Sequence:  i,
+				Timestamp: time.Now(),
+				Payload:   base64.StdEncoding.EncodeToString(payload)[:size],
+			}); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// healthHandler returns a 200 status code or a 503 status code while the server
+// is draining.
+func healthHandler(draining *atomic.Bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			http.Error(w, "Draining", http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintf(w, "OK")
+	}
+}
+
+// timeoutHandler waits the duration defined via the "timeout" query parameter
+// before it returns a 200 status code. When the server is shut down before,
+// a 503 status code is returned.
+func timeoutHandler(shutdown <-chan struct{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+		timeoutString := r.URL.Query().Get("timeout")
+		if timeoutString == "" {
+			http.Error(w, "timout parameter is missing", http.StatusBadRequest)
+			return
+		}
+
+		timeout, err := time.ParseDuration(timeoutString)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		select {
+		case <-time.After(timeout):
+			w.WriteHeader(200)
+		case <-shutdown:
+			http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		case <-r.Context().Done():
+			http.Error(w, r.Context().Err().Error(), http.StatusRequestTimeout)
+		}
+	}
+}
+
+// fingerprintHandler returns a SHA-256 fingerprint of the normalized request.
+// The request properties used for the fingerprint can be set via the
+// "include" query parameter.
+func fingerprintHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+	include := []string{"headers", "method", "path"}
+	if includeString := r.URL.Query().Get("include"); includeString != "" {
+		include = strings.Split(includeString, ",")
+	}
+
+	components := make(map[string]string)
+	for _, component := range include {
+		switch component {
+		case "headers":
+			var headers []string
+			for name, values := range r.Header {
+				if slices.Contains(hopByHopHeaders, name) {
+					continue
+				}
+				headers = append(headers, fmt.Sprintf("%s: %s", strings.ToLower(name), strings.Join(values, ",")))
+			}
+			sort.Strings(headers)
+			components["headers"] = strings.Join(headers, "\n")
+		case "method":
+			components["method"] = r.Method
+		case "path":
+			components["path"] = r.URL.Path
+		case "body":
+			bodyHash := sha256.New()
+			if _, err := io.Copy(bodyHash, http.MaxBytesReader(w, r.Body, fingerprintMaxBodySize)); err != nil {
+				var maxBytesError *http.MaxBytesError
+				if errors.As(err, &maxBytesError) {
+					http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+					return
+				}
+
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			components["body"] = hex.EncodeToString(bodyHash.Sum(nil))
+		default:
+			http.Error(w, fmt.Sprintf("invalid include parameter: %s", component), http.StatusBadRequest)
+			return
+		}
+	}
+
+	names := make([]string, 0, len(components))
+	for name := range components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s\n%s\n", name, components[name])
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Fingerprint string            `json:"fingerprint"`
+		Components  map[string]string `json:"components"`
+	}{
+		Fingerprint: hex.EncodeToString(hash.Sum(nil)),
+		Components:  components,
+	})
+}
+
+// multipartHandler returns the fields and files of a multipart/form-data body.
+// Values of fields are truncated to multipartMaxValueSize bytes.
+func multipartHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+	type field struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	type file struct {
+		Name        string `json:"name"`
+		Filename    string `json:"filename"`
+		ContentType string `json:"contentType"`
+		Size        int64  `json:"size"`
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, multipartMaxSize)
+	if err := r.ParseMultipartForm(multipartMaxSize); err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	fields := []field{}
+	for name, values := range r.MultipartForm.Value {
+		for _, value := range values {
+			if len(value) > multipartMaxValueSize {
+				// Truncate the value on a character boundary, so that no
+				// invalid UTF-8 sequence is returned.
+				n := multipartMaxValueSize
+				for n > 0 && !utf8.RuneStart(value[n]) {
+					n--
+				}
+				value = value[:n]
+			}
+			fields = append(fields, field{Name: name, Value: value})
+		}
+	}
+
+	files := []file{}
+	for name, headers := range r.MultipartForm.File {
+		for _, header := range headers {
+			files = append(files, file{Name: name, Filename: header.Filename, ContentType: header.Header.Get("Content-Type"), Size: header.Size})
+		}
+	}
+
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Fields []field `json:"fields"`
+		Files  []file  `json:"files"`
+	}{
+		Fields: fields,
+		Files:  files,
+	})
+}
+
+// hijackHandler hijacks the connection, writes a raw HTTP/1.0 response with the
+// body defined via the "response" query parameter and closes the connection.
+func hijackHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+	response := r.URL.Query().Get("response")
+	if response == "" {
+		response = "Hijacked"
+	}
+
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(buf, "HTTP/1.0 200 OK\r\nX-Hijacked: true\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(response), response)
+	buf.Flush()
+}
+
+// trailerHandler returns a body of the size defined via the "size" query
+// parameter and its CRC32 checksum in the X-Checksum trailer.
+func trailerHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+	size := 1024
+	if sizeString := r.URL.Query().Get("size"); sizeString != "" {
+		var err error
+		size, err = strconv.Atoi(sizeString)
+		if err != nil || size < 0 {
+			http.Error(w, "invalid size parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	crc := crc32.NewIEEE()
+
+	w.Header().Set("Trailer", "X-Checksum")
+	w.WriteHeader(http.StatusOK)
+	if err := writeRepeated(io.MultiWriter(w, crc), "0", size); err != nil {
+		return
+	}
+	w.Header().Set("X-Checksum", fmt.Sprintf("%08x", crc.Sum32()))
+}
+
+// redirectHandler redirects to the absolute url defined via the "url" query
+// parameter with the 3xx status code defined via the "code" query parameter.
+func redirectHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+	urlString := r.URL.Query().Get("url")
+	if urlString == "" {
+		http.Error(w, "url parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	redirectURL, err := url.ParseRequestURI(urlString)
+	if err != nil || !redirectURL.IsAbs() || redirectURL.Host == "" {
+		http.Error(w, "url parameter must be an absolute url", http.StatusBadRequest)
+		return
+	}
+
+	code := http.StatusFound
+	if codeString := r.URL.Query().Get("code"); codeString != "" {
+		code, err = strconv.Atoi(codeString)
+		if err != nil || code < 300 || code > 399 {
+			http.Error(w, "code parameter must be a 3xx status code", http.StatusBadRequest)
+			return
+		}
+	}
+
+	http.Redirect(w, r, redirectURL.String(), code)
+}
+
+// echoHandler dumps the HTTP request. Headers can be added to the response via
+// the "addHeader" query parameter.
+func echoHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+	for _, header := range r.URL.Query()["addHeader"] {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok || !headerNameRegexp.MatchString(name) || strings.ContainsAny(value, "\r\n") {
+			http.Error(w, fmt.Sprintf("invalid addHeader parameter: %s", header), http.StatusBadRequest)
+			return
+		}
+
+		name = http.CanonicalHeaderKey(name)
+		if slices.Contains(hopByHopHeaders, name) || name == "Content-Length" {
+			http.Error(w, fmt.Sprintf("connection-level header is not allowed: %s", name), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Add(name, strings.TrimSpace(value))
+	}
+
+	dump, err := httputil.DumpRequest(r, true)
+	if err != nil {
+		http.Error(w, fmt.Sprint(err), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "%s", string(dump))
+}
+
+// goroutinesHandler returns the stacks of all goroutines as JSON. Goroutines
+// can be filtered via the "filter" and "min" query parameters.
+func goroutinesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Printf("host: %s, address: %s, method: %s, requestURI: %s, proto: %s, useragent: %s", r.Host, r.RemoteAddr, r.Method, r.RequestURI, r.Proto, r.UserAgent())
+
+	minCount := 1
+	if minString := r.URL.Query().Get("min"); minString != "" {
+		var err error
+		minCount, err = strconv.Atoi(minString)
+		if err != nil {
+			http.Error(w, "invalid min parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	filter := r.URL.Query().Get("filter")
+
+	// Goroutines are grouped by their top function, so that only goroutines can
+	// be returned, where at least "min" goroutines are running the same
+	// function.
+	all := goroutines()
+	functions := make(map[string]int)
+	for _, g := range all {
+		functions[g.Function]++
+	}
+
+	filtered := []goroutine{}
+	for _, g := range all {
+		if functions[g.Function] >= minCount && strings.Contains(g.Stack, filter) {
+			filtered = append(filtered, g)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Count      int         `json:"count"`
+		Goroutines []goroutine `json:"goroutines"`
+	}{
+		Count:      len(filtered),
+		Goroutines: filtered,
+	})
+}
+
+// openapiHandler returns the given OpenAPI specification with the given
+// content type.
+func openapiHandler(contentType string, spec []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write(spec)
+	}
+}
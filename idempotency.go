@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyMaxBodySize = 1 << 20
+)
+
+// idempotencyEntry is the response for a single idempotency key. The done
+// channel is closed, when the response was recorded or when the response could
+// not be recorded. In the latter case recorded is false.
+type idempotencyEntry struct {
+	key        string
+	created    time.Time
+	done       chan struct{}
+	recorded   bool
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+// idempotencyCache is a LRU cache for the responses of requests with an
+// Idempotency-Key header.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	maxKeys int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newIdempotencyCache(ttl time.Duration, maxKeys int) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// getOrCreate returns the entry for the given key. If there is no entry or the
+// entry is expired, a new entry is created and the second return value is
+// true. The caller is then responsible for recording the response.
+func (c *idempotencyCache) getOrCreate(key string) (*idempotencyEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*idempotencyEntry)
+		if time.Since(entry.created) < c.ttl {
+			c.lru.MoveToFront(element)
+			return entry, false
+		}
+
+		c.lru.Remove(element)
+		delete(c.entries, key)
+	}
+
+	entry := &idempotencyEntry{key: key, created: time.Now(), done: make(chan struct{})}
+	c.entries[key] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.maxKeys {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*idempotencyEntry).key)
+	}
+
+	return entry, true
+}
+
+// remove removes the given entry from the cache, so that the next request with
+// the same key creates a new entry.
+func (c *idempotencyCache) remove(entry *idempotencyEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[entry.key]; ok && element.Value == entry {
+		c.lru.Remove(element)
+		delete(c.entries, entry.key)
+	}
+}
+
+// idempotencyResponseWriter captures the status code and the body written by
+// the handler. When the body is larger than 1MB, the body is discarded and
+// tooLarge is set.
+type idempotencyResponseWriter struct {
+	*responseWriter
+	body     bytes.Buffer
+	tooLarge bool
+}
+
+func (w *idempotencyResponseWriter) Write(b []byte) (int, error) {
+	if !w.tooLarge {
+		if w.body.Len()+len(b) > idempotencyMaxBodySize {
+			w.tooLarge = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(b)
+		}
+	}
+
+	return w.responseWriter.Write(b)
+}
+
+// idempotency replays the response of a previous POST or PUT request with the
+// same Idempotency-Key header. If the previous request is still in progress,
+// the request waits until the previous request is completed. Responses with a
+// body larger than 1MB and responses of panicking handlers are not replayed; the
+// waiting requests are executed again instead.
+func idempotency(cache *idempotencyCache) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if key == "" || (r.Method != http.MethodPost && r.Method != http.MethodPut) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var entry *idempotencyEntry
+			for entry == nil || !entry.recorded {
+				var created bool
+				entry, created = cache.getOrCreate(key)
+				if created {
+					// The response is only recorded, when the handler returns
+					// normally. If the handler panics, the partial response is
+					// not replayed and the waiting requests are executed again.
+					rw := &idempotencyResponseWriter{responseWriter: newResponseWriter(w)}
+					completed := false
+					defer func() {
+						if completed && !rw.tooLarge {
+							entry.statusCode = rw.statusCode
+							entry.header = w.Header().Clone()
+							entry.body = rw.body.Bytes()
+							entry.recorded = true
+						} else {
+							cache.remove(entry)
+						}
+						close(entry.done)
+					}()
+
+					next.ServeHTTP(rw, r)
+					completed = true
+					return
+				}
+
+				select {
+				case <-entry.done:
+				case <-r.Context().Done():
+					http.Error(w, "request with the same idempotency key is still in progress", http.StatusConflict)
+					return
+				}
+			}
+
+			// Headers which were already set by other middlewares, like the
+			// correlation id, are not overwritten by the recorded headers.
+			for name, values := range entry.header {
+				if _, ok := w.Header()[name]; !ok {
+					w.Header()[name] = values
+				}
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.statusCode)
+			w.Write(entry.body)
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotency(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		method        string
+		keys          []string
+		size          int
+		expectedCalls int32
+		replayed      []bool
+	}{
+		{name: "replay", method: http.MethodPost, keys: []string{"a", "a"}, size: 16, expectedCalls: 1, replayed: []bool{false, true}},
+		{name: "different keys", method: http.MethodPut, keys: []string{"a", "b"}, size: 16, expectedCalls: 2, replayed: []bool{false, false}},
+		{name: "no key", method: http.MethodPost, keys: []string{"", ""}, size: 16, expectedCalls: 2, replayed: []bool{false, false}},
+		{name: "unsupported method", method: http.MethodPatch, keys: []string{"a", "a"}, size: 16, expectedCalls: 2, replayed: []bool{false, false}},
+		{name: "body too large", method: http.MethodPost, keys: []string{"a", "a"}, size: idempotencyMaxBodySize + 1, expectedCalls: 2, replayed: []bool{false, false}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int32
+			handler := idempotency(newIdempotencyCache(time.Hour, 10))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				call := calls.Add(1)
+				w.Header().Set("X-Call", strconv.Itoa(int(call)))
+				w.WriteHeader(http.StatusCreated)
+				writeRepeated(w, "x", tc.size)
+			}))
+
+			for i, key := range tc.keys {
+				req := httptest.NewRequest(tc.method, "/", nil)
+				if key != "" {
+					req.Header.Set("Idempotency-Key", key)
+				}
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, req)
+
+				if rec.Code != http.StatusCreated {
+					t.Errorf("request %d: expected status code %d, got %d", i, http.StatusCreated, rec.Code)
+				}
+				if rec.Body.Len() != tc.size {
+					t.Errorf("request %d: expected body size %d, got %d", i, tc.size, rec.Body.Len())
+				}
+				if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != tc.replayed[i] {
+					t.Errorf("request %d: expected replayed %t, got %t", i, tc.replayed[i], replayed)
+				}
+			}
+
+			if calls.Load() != tc.expectedCalls {
+				t.Errorf("expected %d calls, got %d", tc.expectedCalls, calls.Load())
+			}
+		})
+	}
+}
+
+func TestIdempotencyInFlight(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		size          int
+		expectedCalls int32
+	}{
+		{name: "wait for response", size: 16, expectedCalls: 1},
+		{name: "execute again when body is too large", size: idempotencyMaxBodySize + 1, expectedCalls: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int32
+			started := make(chan struct{}, 2)
+			release := make(chan struct{})
+
+			handler := idempotency(newIdempotencyCache(time.Hour, 10))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				started <- struct{}{}
+				<-release
+				writeRepeated(w, "x", tc.size)
+			}))
+
+			var wg sync.WaitGroup
+			recs := []*httptest.ResponseRecorder{httptest.NewRecorder(), httptest.NewRecorder()}
+			serve := func(rec *httptest.ResponseRecorder) {
+				defer wg.Done()
+				req := httptest.NewRequest(http.MethodPost, "/", nil)
+				req.Header.Set("Idempotency-Key", "a")
+				handler.ServeHTTP(rec, req)
+			}
+
+			wg.Add(1)
+			go serve(recs[0])
+			<-started
+
+			wg.Add(1)
+			go serve(recs[1])
+
+			// Give the second request time to start waiting for the first one,
+			// before the first request is completed.
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			wg.Wait()
+
+			if calls.Load() != tc.expectedCalls {
+				t.Errorf("expected %d calls, got %d", tc.expectedCalls, calls.Load())
+			}
+			for i, rec := range recs {
+				if rec.Body.Len() != tc.size {
+					t.Errorf("request %d: expected body size %d, got %d", i, tc.size, rec.Body.Len())
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotencyCacheEviction(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		maxKeys  int
+		keys     []string
+		expected map[string]bool
+	}{
+		{name: "evict oldest key", maxKeys: 2, keys: []string{"a", "b", "c"}, expected: map[string]bool{"a": false, "b": true, "c": true}},
+		{name: "used key is not evicted", maxKeys: 2, keys: []string{"a", "b", "a", "c"}, expected: map[string]bool{"a": true, "b": false, "c": true}},
+		{name: "no eviction", maxKeys: 3, keys: []string{"a", "b", "c"}, expected: map[string]bool{"a": true, "b": true, "c": true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cache := newIdempotencyCache(time.Hour, tc.maxKeys)
+			for _, key := range tc.keys {
+				cache.getOrCreate(key)
+			}
+
+			if len(cache.entries) != cache.lru.Len() || cache.lru.Len() > tc.maxKeys {
+				t.Errorf("expected at most %d entries, got %d entries and %d list elements", tc.maxKeys, len(cache.entries), cache.lru.Len())
+			}
+			for key, cached := range tc.expected {
+				if _, ok := cache.entries[key]; ok != cached {
+					t.Errorf("key %s: expected cached %t, got %t", key, cached, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestIdempotencyPanic(t *testing.T) {
+	var calls atomic.Int32
+	handler := idempotency(newIdempotencyCache(time.Hour, 10))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			w.Write([]byte("partial"))
+			panic(http.ErrAbortHandler)
+		}
+		w.Write([]byte("complete"))
+	}))
+
+	serve := func() (rec *httptest.ResponseRecorder, panicked bool) {
+		defer func() {
+			panicked = recover() != nil
+		}()
+
+		rec = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.Header.Set("Idempotency-Key", "a")
+		handler.ServeHTTP(rec, req)
+		return rec, false
+	}
+
+	if _, panicked := serve(); !panicked {
+		t.Fatal("expected first request to panic")
+	}
+
+	rec, panicked := serve()
+	if panicked {
+		t.Fatal("expected second request not to panic")
+	}
+	if rec.Body.String() != "complete" {
+		t.Errorf("expected body %q, got %q", "complete", rec.Body.String())
+	}
+	if rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("expected response of the panicking request not to be replayed")
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 calls, got %d", calls.Load())
+	}
+}
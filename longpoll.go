@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+)
+
+// longpollBroker delivers published messages to all subscribers of a topic.
+// Each subscriber receives at most one message and is removed from the topic
+// afterwards.
+type longpollBroker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan []byte]struct{}
+}
+
+func newLongpollBroker() *longpollBroker {
+	return &longpollBroker{
+		subscribers: make(map[string]map[chan []byte]struct{}),
+	}
+}
+
+// subscribe returns a channel, which receives the next message published to
+// the given topic.
+func (b *longpollBroker) subscribe(topic string) chan []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan []byte, 1)
+	if b.subscribers[topic] == nil {
+		b.subscribers[topic] = make(map[chan []byte]struct{})
+	}
+	b.subscribers[topic][ch] = struct{}{}
+
+	return ch
+}
+
+// unsubscribe removes the channel from the given topic, e.g. when the request
+// timed out before a message was published.
+func (b *longpollBroker) unsubscribe(topic string, ch chan []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.subscribers[topic], ch)
+	if len(b.subscribers[topic]) == 0 {
+		delete(b.subscribers, topic)
+	}
+}
+
+// publish sends the message to all subscribers of the given topic and returns
+// the number of subscribers.
+func (b *longpollBroker) publish(topic string, message []byte) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subscribers := b.subscribers[topic]
+	delete(b.subscribers, topic)
+
+	for ch := range subscribers {
+		ch <- message
+	}
+
+	return len(subscribers)
+}
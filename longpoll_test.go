@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLongpollBroker(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		subscribers   map[string]int
+		unsubscribe   map[string]int
+		topic         string
+		expectedCount int
+	}{
+		{name: "fan-out", subscribers: map[string]int{"a": 3, "b": 1}, topic: "a", expectedCount: 3},
+		{name: "no subscribers", subscribers: map[string]int{"b": 1}, topic: "a", expectedCount: 0},
+		{name: "unsubscribe", subscribers: map[string]int{"a": 3}, unsubscribe: map[string]int{"a": 2}, topic: "a", expectedCount: 1},
+		{name: "unsubscribe all", subscribers: map[string]int{"a": 2}, unsubscribe: map[string]int{"a": 2}, topic: "a", expectedCount: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			broker := newLongpollBroker()
+
+			channels := make(map[string][]chan []byte)
+			for topic, count := range tc.subscribers {
+				for i := 0; i < count; i++ {
+					channels[topic] = append(channels[topic], broker.subscribe(topic))
+				}
+			}
+			for topic, count := range tc.unsubscribe {
+				for _, ch := range channels[topic][:count] {
+					broker.unsubscribe(topic, ch)
+				}
+				channels[topic] = channels[topic][count:]
+			}
+
+			if count := broker.publish(tc.topic, []byte("message")); count != tc.expectedCount {
+				t.Errorf("expected %d subscribers, got %d", tc.expectedCount, count)
+			}
+
+			for topic, chs := range channels {
+				for i, ch := range chs {
+					select {
+					case message := <-ch:
+						if topic != tc.topic {
+							t.Errorf("topic %s, subscriber %d: unexpected message %q", topic, i, message)
+						} else if string(message) != "message" {
+							t.Errorf("topic %s, subscriber %d: expected message %q, got %q", topic, i, "message", message)
+						}
+					default:
+						if topic == tc.topic {
+							t.Errorf("topic %s, subscriber %d: expected message", topic, i)
+						}
+					}
+				}
+			}
+
+			// Each subscriber receives at most one message, so a second
+			// message must not be delivered to any subscriber.
+			if count := broker.publish(tc.topic, []byte("message")); count != 0 {
+				t.Errorf("expected 0 subscribers for the second message, got %d", count)
+			}
+			if _, ok := broker.subscribers[tc.topic]; ok {
+				t.Errorf("expected topic %s to be removed", tc.topic)
+			}
+		})
+	}
+}
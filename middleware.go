@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	auditLogMaxBodySize       = 64 << 10
+	mirrorMaxBodySize         = 1 << 20
+	methodOverrideMaxBodySize = 10 << 20
+)
+
+type correlationIDKey struct{}
+
+var (
+	mirrorClient    = &http.Client{Timeout: 10 * time.Second}
+	overrideMethods = []string{http.MethodPut, http.MethodPatch, http.MethodDelete}
+)
+
+// readBody reads up to limit bytes of the request body and re-injects them,
+// so that the next handler can still read the complete body.
+func readBody(r *http.Request, limit int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit))
+	if err != nil {
+		return nil, err
+	}
+
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+	return body, nil
+}
+
+// responseWriter wraps a http.ResponseWriter to capture the status code which
+// was written by the handler. The underlying writer is exposed via Unwrap, so
+// that a http.ResponseController can still be used to flush or hijack the
+// connection.
+type responseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func newResponseWriter(w http.ResponseWriter) *responseWriter {
+	return &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+}
+
+func (w *responseWriter) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// auditLog logs all requests which are using a mutating HTTP method (POST,
+// PUT, PATCH and DELETE). Besides the request properties the log line
+// contains the returned status code and the SHA-256 hash of the first 64KB of
+// the request body. All other requests are passed through.
+func auditLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+
+		body, err := readBody(r, auditLogMaxBodySize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		bodyHash := sha256.Sum256(body)
+
+		rw := newResponseWriter(w)
+		next.ServeHTTP(rw, r)
+
+		log.Printf("audit: correlationId: %s, method: %s, url: %s, address: %s, status: %d, bodyHash: %s, duration: %s", getCorrelationID(r.Context()), r.Method, r.URL.String(), r.RemoteAddr, rw.statusCode, hex.EncodeToString(bodyHash[:]), time.Since(start))
+	})
+}
+
+// mirror sends a copy of each request to the given url. The copy is sent
+// asynchronously via a POST request, so that the response for the original
+// request is not affected by the mirror target. The copy contains the headers
+// and the first 1MB of the body of the original request. The original method
+// and url are set in the X-Mirror-Method and X-Mirror-Source headers. Requests
+// which already contain a X-Mirror-Source header are not mirrored again, so
+// that no loop is created when the mirror target is an echoserver.
+func mirror(mirrorURL string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-Mirror-Source") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body, err := readBody(r, mirrorMaxBodySize)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			header := r.Header.Clone()
+			source := r.URL.String()
+			method := r.Method
+
+			go func() {
+				req, err := http.NewRequest(http.MethodPost, mirrorURL, bytes.NewReader(body))
+				if err != nil {
+					log.Printf("Could not create mirror request: %s", err.Error())
+					return
+				}
+
+				req.Header = header
+				req.Header.Set("X-Mirror-Source", source)
+				req.Header.Set("X-Mirror-Method", method)
+
+				resp, err := mirrorClient.Do(req)
+				if err != nil {
+					log.Printf("Could not mirror request: %s", err.Error())
+					return
+				}
+				defer resp.Body.Close()
+				io.Copy(io.Discard, resp.Body)
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// correlationID reads the correlation id of a request from the
+// X-Correlation-ID header or the X-Request-ID header. If both headers are not
+// set a new correlation id is generated. The correlation id is stored in the
+// request context and returned in the X-Correlation-ID response header.
+func correlationID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Correlation-ID")
+		if id == "" {
+			id = r.Header.Get("X-Request-ID")
+		}
+		if id == "" {
+			b := make([]byte, 16)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+		}
+
+		w.Header().Set("X-Correlation-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), correlationIDKey{}, id)))
+	})
+}
+
+// getCorrelationID returns the correlation id from the given context. If the
+// context does not contain a correlation id an empty string is returned.
+func getCorrelationID(ctx context.Context) string {
+	if id, ok := ctx.Value(correlationIDKey{}).(string); ok {
+		return id
+	}
+
+	return ""
+}
+
+// methodOverride replaces the method of POST requests with the method from the
+// X-HTTP-Method-Override header or the "_method" form field, so that HTML forms
+// can be used to send PUT, PATCH and DELETE requests. An override with POST is
+// ignored and other methods are rejected.
+// The body is re-injected after the form was parsed, so that the next handler
+// can still read it.
+func methodOverride(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		method := r.Header.Get("X-HTTP-Method-Override")
+		if method == "" {
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+				body, err := readBody(r, methodOverrideMaxBodySize)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+
+				form, err := url.ParseQuery(string(body))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				method = form.Get("_method")
+			}
+		}
+
+		method = strings.ToUpper(method)
+		if method == "" || method == r.Method {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !slices.Contains(overrideMethods, method) {
+			http.Error(w, fmt.Sprintf("invalid method override: %s", method), http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("method override: original: %s, override: %s", r.Method, method)
+		r.Method = method
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deadline sets a deadline for the request context, when the request contains
+// a X-Request-Deadline header (RFC 3339 timestamp or Unix milliseconds) or a
+// X-Request-Timeout header (duration). If the deadline is already exceeded a
+// 408 status code is returned.
+func deadline(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var d time.Time
+
+		if deadlineString := r.Header.Get("X-Request-Deadline"); deadlineString != "" {
+			if ms, err := strconv.ParseInt(deadlineString, 10, 64); err == nil {
+				d = time.UnixMilli(ms)
+			} else if t, err := time.Parse(time.RFC3339, deadlineString); err == nil {
+				d = t
+			} else {
+				http.Error(w, "invalid X-Request-Deadline header", http.StatusBadRequest)
+				return
+			}
+		} else if timeoutString := r.Header.Get("X-Request-Timeout"); timeoutString != "" {
+			timeout, err := time.ParseDuration(timeoutString)
+			if err != nil {
+				http.Error(w, "invalid X-Request-Timeout header", http.StatusBadRequest)
+				return
+			}
+			d = time.Now().Add(timeout)
+		}
+
+		if d.IsZero() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !d.After(time.Now()) {
+			http.Error(w, "request deadline exceeded", http.StatusRequestTimeout)
+			return
+		}
+
+		ctx, cancel := context.WithDeadline(r.Context(), d)
+		defer cancel()
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// statusOverrideResponseWriter replaces the status code written by the handler
+// with the configured status code. When the handler hijacked the connection,
+// no status code is written.
+type statusOverrideResponseWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (w *statusOverrideResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader || w.hijacked {
+		return
+	}
+
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(w.statusCode)
+}
+
+func (w *statusOverrideResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusOverrideResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusOverrideResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, buf, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+
+	return conn, buf, err
+}
+
+// statusOverride replaces the status code of the response with the status code
+// from the X-Override-Status header. To prevent abuse the request must also
+// contain the given token in the X-Override-Status-Token header.
+func statusOverride(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			statusString := r.Header.Get("X-Override-Status")
+			if statusString == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Override-Status-Token")), []byte(token)) != 1 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			status, err := strconv.Atoi(statusString)
+			if err != nil || status < 200 || status > 599 {
+				http.Error(w, "invalid X-Override-Status header", http.StatusBadRequest)
+				return
+			}
+
+			rw := &statusOverrideResponseWriter{ResponseWriter: w, statusCode: status}
+			next.ServeHTTP(rw, r)
+			rw.WriteHeader(status)
+		})
+	}
+}
+
+// bearerAuth only allows requests, which contain one of the given tokens in
+// the Authorization header. Requests for one of the exempt paths are always
+// allowed.
+func bearerAuth(tokens, exemptPaths []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(exemptPaths, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// The authentication scheme is case-insensitive (RFC 9110, section
+			// 11.1), so that "bearer <token>" is also accepted.
+			scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+
+			valid := 0
+			if ok && strings.EqualFold(scheme, "Bearer") {
+				for _, t := range tokens {
+					valid |= subtle.ConstantTimeCompare([]byte(token), []byte(t))
+				}
+			}
+
+			if valid != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="echoserver"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// headerLimit returns a 431 status code, when a request contains more than
+// maxCount headers or when the value of a header is larger than maxValueBytes.
+// A limit of 0 disables the corresponding check.
+func headerLimit(maxCount, maxValueBytes int) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count := 0
+			for name, values := range r.Header {
+				count += len(values)
+
+				if maxValueBytes > 0 {
+					for _, value := range values {
+						if len(value) > maxValueBytes {
+							log.Printf("header limit: header %s has %d bytes, limit is %d bytes", name, len(value), maxValueBytes)
+							http.Error(w, fmt.Sprintf("value of header %s is too large", name), http.StatusRequestHeaderFieldsTooLarge)
+							return
+						}
+					}
+				}
+			}
+
+			if maxCount > 0 && count > maxCount {
+				log.Printf("header limit: request has %d headers, limit is %d headers", count, maxCount)
+				http.Error(w, "too many headers", http.StatusRequestHeaderFieldsTooLarge)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
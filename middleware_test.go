@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBearerAuth(t *testing.T) {
+	handler := bearerAuth([]string{"token1", "token2"}, []string{"/health"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tc := range []struct {
+		name               string
+		path               string
+		authorization      string
+		expectedStatusCode int
+	}{
+		{name: "valid token", path: "/", authorization: "Bearer token1", expectedStatusCode: http.StatusOK},
+		{name: "second valid token", path: "/", authorization: "Bearer token2", expectedStatusCode: http.StatusOK},
+		{name: "lowercase scheme", path: "/", authorization: "bearer token1", expectedStatusCode: http.StatusOK},
+		{name: "uppercase scheme", path: "/", authorization: "BEARER token1", expectedStatusCode: http.StatusOK},
+		{name: "invalid token", path: "/", authorization: "Bearer invalid", expectedStatusCode: http.StatusUnauthorized},
+		{name: "token prefix", path: "/", authorization: "Bearer token", expectedStatusCode: http.StatusUnauthorized},
+		{name: "invalid scheme", path: "/", authorization: "Basic token1", expectedStatusCode: http.StatusUnauthorized},
+		{name: "missing token", path: "/", authorization: "Bearer", expectedStatusCode: http.StatusUnauthorized},
+		{name: "missing header", path: "/", authorization: "", expectedStatusCode: http.StatusUnauthorized},
+		{name: "exempt path", path: "/health", authorization: "", expectedStatusCode: http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.expectedStatusCode {
+				t.Fatalf("expected status code %d, got %d", tc.expectedStatusCode, rec.Code)
+			}
+			if authenticate := rec.Header().Get("WWW-Authenticate"); (tc.expectedStatusCode == http.StatusUnauthorized) != (authenticate != "") {
+				t.Errorf("unexpected WWW-Authenticate header %q for status code %d", authenticate, rec.Code)
+			}
+		})
+	}
+}
+
+func TestStatusOverride(t *testing.T) {
+	handler := statusOverride("secret")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "OK")
+	}))
+
+	for _, tc := range []struct {
+		name               string
+		status             string
+		token              string
+		expectedStatusCode int
+	}{
+		{name: "override", status: "503", token: "secret", expectedStatusCode: http.StatusServiceUnavailable},
+		{name: "override with success status code", status: "201", token: "secret", expectedStatusCode: http.StatusCreated},
+		{name: "missing token", status: "503", token: "", expectedStatusCode: http.StatusOK},
+		{name: "invalid token", status: "503", token: "invalid", expectedStatusCode: http.StatusOK},
+		{name: "missing status", status: "", token: "secret", expectedStatusCode: http.StatusOK},
+		{name: "invalid status", status: "invalid", token: "secret", expectedStatusCode: http.StatusBadRequest},
+		{name: "status too low", status: "199", token: "secret", expectedStatusCode: http.StatusBadRequest},
+		{name: "status too high", status: "600", token: "secret", expectedStatusCode: http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Override-Status", tc.status)
+			req.Header.Set("X-Override-Status-Token", tc.token)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.expectedStatusCode {
+				t.Fatalf("expected status code %d, got %d", tc.expectedStatusCode, rec.Code)
+			}
+			if tc.expectedStatusCode != http.StatusBadRequest && rec.Body.String() != "OK" {
+				t.Errorf("expected body %q, got %q", "OK", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestStatusOverrideHijack(t *testing.T) {
+	done := make(chan struct{})
+	handler := statusOverride("secret")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(buf, "HTTP/1.0 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nHijacked")
+		buf.Flush()
+	}))
+
+	var errorLog bytes.Buffer
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		handler.ServeHTTP(w, r)
+	}))
+	server.Config.ErrorLog = log.New(&errorLog, "", 0)
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect to server: %s", err.Error())
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nX-Override-Status: 503\r\nX-Override-Status-Token: secret\r\n\r\n")
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("could not read response: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("could not read body: %s", err.Error())
+	}
+
+	if resp.StatusCode != http.StatusOK || string(body) != "Hijacked" {
+		t.Errorf("expected the hijacked response, got status code %d and body %q", resp.StatusCode, string(body))
+	}
+
+	<-done
+	if strings.Contains(errorLog.String(), "hijacked") {
+		t.Errorf("expected no status code to be written after the hijack, got log %q", errorLog.String())
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name               string
+		header             string
+		value              string
+		wait               bool
+		expectedStatusCode int
+		expectedDeadline   time.Time
+	}{
+		{name: "no deadline", expectedStatusCode: http.StatusOK},
+		{name: "rfc 3339 deadline", header: "X-Request-Deadline", value: now.Add(time.Hour).Format(time.RFC3339), expectedStatusCode: http.StatusOK, expectedDeadline: now.Add(time.Hour)},
+		{name: "unix milliseconds deadline", header: "X-Request-Deadline", value: strconv.FormatInt(now.Add(time.Hour).UnixMilli(), 10), expectedStatusCode: http.StatusOK, expectedDeadline: now.Add(time.Hour)},
+		{name: "timeout", header: "X-Request-Timeout", value: "1h", expectedStatusCode: http.StatusOK, expectedDeadline: now.Add(time.Hour)},
+		{name: "exceeded rfc 3339 deadline", header: "X-Request-Deadline", value: now.Add(-time.Hour).Format(time.RFC3339), expectedStatusCode: http.StatusRequestTimeout},
+		{name: "exceeded unix milliseconds deadline", header: "X-Request-Deadline", value: strconv.FormatInt(now.Add(-time.Hour).UnixMilli(), 10), expectedStatusCode: http.StatusRequestTimeout},
+		{name: "negative timeout", header: "X-Request-Timeout", value: "-1s", expectedStatusCode: http.StatusRequestTimeout},
+		{name: "invalid deadline", header: "X-Request-Deadline", value: "tomorrow", expectedStatusCode: http.StatusBadRequest},
+		{name: "invalid timeout", header: "X-Request-Timeout", value: "10", expectedStatusCode: http.StatusBadRequest},
+		{name: "short timeout", header: "X-Request-Timeout", value: "10ms", wait: true, expectedStatusCode: http.StatusRequestTimeout, expectedDeadline: now.Add(10 * time.Millisecond)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var ctxDeadline time.Time
+			var ctxHasDeadline bool
+
+			handler := deadline(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				ctxDeadline, ctxHasDeadline = r.Context().Deadline()
+
+				if tc.wait {
+					select {
+					case <-r.Context().Done():
+					case <-time.After(time.Second):
+						return
+					}
+				}
+
+				if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+					w.WriteHeader(http.StatusRequestTimeout)
+				}
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.header != "" {
+				req.Header.Set(tc.header, tc.value)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.expectedStatusCode {
+				t.Fatalf("expected status code %d, got %d", tc.expectedStatusCode, rec.Code)
+			}
+			if ctxHasDeadline != !tc.expectedDeadline.IsZero() {
+				t.Fatalf("expected context deadline %t, got %t", !tc.expectedDeadline.IsZero(), ctxHasDeadline)
+			}
+			if ctxHasDeadline && ctxDeadline.Sub(tc.expectedDeadline).Abs() > time.Second {
+				t.Errorf("expected context deadline %s, got %s", tc.expectedDeadline, ctxDeadline)
+			}
+		})
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		method             string
+		header             string
+		contentType        string
+		body               string
+		expectedStatusCode int
+		expectedMethod     string
+	}{
+		{name: "no override", method: http.MethodPost, expectedStatusCode: http.StatusOK, expectedMethod: http.MethodPost},
+		{name: "header", method: http.MethodPost, header: "DELETE", expectedStatusCode: http.StatusOK, expectedMethod: http.MethodDelete},
+		{name: "lowercase header", method: http.MethodPost, header: "patch", expectedStatusCode: http.StatusOK, expectedMethod: http.MethodPatch},
+		{name: "form", method: http.MethodPost, contentType: "application/x-www-form-urlencoded", body: "_method=PUT&name=test", expectedStatusCode: http.StatusOK, expectedMethod: http.MethodPut},
+		{name: "form without override", method: http.MethodPost, contentType: "application/x-www-form-urlencoded", body: "name=test", expectedStatusCode: http.StatusOK, expectedMethod: http.MethodPost},
+		{name: "form with other content type", method: http.MethodPost, contentType: "text/plain", body: "_method=PUT", expectedStatusCode: http.StatusOK, expectedMethod: http.MethodPost},
+		{name: "override with original method", method: http.MethodPost, header: "POST", expectedStatusCode: http.StatusOK, expectedMethod: http.MethodPost},
+		{name: "invalid method", method: http.MethodPost, header: "GET", expectedStatusCode: http.StatusBadRequest},
+		{name: "no post request", method: http.MethodGet, header: "DELETE", expectedStatusCode: http.StatusOK, expectedMethod: http.MethodGet},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var method string
+			var body []byte
+
+			handler := methodOverride(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method = r.Method
+				body, _ = io.ReadAll(r.Body)
+			}))
+
+			req := httptest.NewRequest(tc.method, "/", strings.NewReader(tc.body))
+			if tc.header != "" {
+				req.Header.Set("X-HTTP-Method-Override", tc.header)
+			}
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.expectedStatusCode {
+				t.Fatalf("expected status code %d, got %d", tc.expectedStatusCode, rec.Code)
+			}
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			if method != tc.expectedMethod {
+				t.Errorf("expected method %s, got %s", tc.expectedMethod, method)
+			}
+			if string(body) != tc.body {
+				t.Errorf("expected body %q, got %q", tc.body, string(body))
+			}
+		})
+	}
+}
+
+func TestMethodOverrideRecordings(t *testing.T) {
+	store := newRecordingStore(10)
+	store.add(recording{Path: "/"})
+
+	req := httptest.NewRequest(http.MethodPost, "/debug/recordings", strings.NewReader("_method=DELETE"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rec := httptest.NewRecorder()
+	methodOverride(recordingsHandler(store)).ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("expected status code %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if recordings := store.list(); len(recordings) != 0 {
+		t.Errorf("expected recordings to be deleted, got %d recordings", len(recordings))
+	}
+}
+
+func TestHeaderLimit(t *testing.T) {
+	for _, tc := range []struct {
+		name               string
+		maxCount           int
+		maxValueBytes      int
+		headers            int
+		valueBytes         int
+		expectedStatusCode int
+	}{
+		{name: "below limits", maxCount: 5, maxValueBytes: 10, headers: 5, valueBytes: 10, expectedStatusCode: http.StatusOK},
+		{name: "too many headers", maxCount: 5, maxValueBytes: 10, headers: 6, valueBytes: 1, expectedStatusCode: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "too large value", maxCount: 5, maxValueBytes: 10, headers: 1, valueBytes: 11, expectedStatusCode: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "count limit only", maxCount: 5, maxValueBytes: 0, headers: 5, valueBytes: 10000, expectedStatusCode: http.StatusOK},
+		{name: "count limit only exceeded", maxCount: 5, maxValueBytes: 0, headers: 6, valueBytes: 1, expectedStatusCode: http.StatusRequestHeaderFieldsTooLarge},
+		{name: "value limit only", maxCount: 0, maxValueBytes: 10, headers: 100, valueBytes: 10, expectedStatusCode: http.StatusOK},
+		{name: "value limit only exceeded", maxCount: 0, maxValueBytes: 10, headers: 1, valueBytes: 11, expectedStatusCode: http.StatusRequestHeaderFieldsTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			handler := headerLimit(tc.maxCount, tc.maxValueBytes)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for i := 0; i < tc.headers; i++ {
+				req.Header.Set(fmt.Sprintf("X-Header-%d", i), strings.Repeat("a", tc.valueBytes))
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tc.expectedStatusCode {
+				t.Errorf("expected status code %d, got %d", tc.expectedStatusCode, rec.Code)
+			}
+		})
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		headers       map[string]string
+		expectedID    string
+		expectedNewID bool
+	}{
+		{name: "correlation id", headers: map[string]string{"X-Correlation-ID": "correlation"}, expectedID: "correlation"},
+		{name: "request id", headers: map[string]string{"X-Request-ID": "request"}, expectedID: "request"},
+		{name: "correlation id before request id", headers: map[string]string{"X-Correlation-ID": "correlation", "X-Request-ID": "request"}, expectedID: "correlation"},
+		{name: "missing id", headers: map[string]string{}, expectedNewID: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var contextID string
+			handler := correlationID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				contextID = getCorrelationID(r.Context())
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			id := rec.Header().Get("X-Correlation-ID")
+			if tc.expectedNewID {
+				if len(id) != 32 {
+					t.Errorf("expected a generated id with 32 characters, got %q", id)
+				}
+			} else if id != tc.expectedID {
+				t.Errorf("expected id %q, got %q", tc.expectedID, id)
+			}
+			if contextID != id {
+				t.Errorf("expected id %q in the request context, got %q", id, contextID)
+			}
+		})
+	}
+
+	t.Run("unique generated ids", func(t *testing.T) {
+		handler := correlationID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		ids := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			ids[rec.Header().Get("X-Correlation-ID")] = true
+		}
+
+		if len(ids) != 100 {
+			t.Errorf("expected 100 unique ids, got %d", len(ids))
+		}
+	})
+
+	if id := getCorrelationID(context.Background()); id != "" {
+		t.Errorf("expected no id for a context without correlation id, got %q", id)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tc := range []struct {
+		method        string
+		body          string
+		expectedLines int
+	}{
+		{method: http.MethodGet, expectedLines: 0},
+		{method: http.MethodHead, expectedLines: 0},
+		{method: http.MethodPost, body: "test", expectedLines: 1},
+		{method: http.MethodPut, body: strings.Repeat("a", 2*auditLogMaxBodySize), expectedLines: 1},
+		{method: http.MethodPatch, body: "test", expectedLines: 1},
+		{method: http.MethodDelete, expectedLines: 1},
+	} {
+		t.Run(tc.method, func(t *testing.T) {
+			logs.Reset()
+
+			var body []byte
+			handler := auditLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusCreated)
+			}))
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(tc.method, "/audit", strings.NewReader(tc.body)))
+
+			if string(body) != tc.body {
+				t.Errorf("expected the handler to read the body with %d bytes, got %d bytes", len(tc.body), len(body))
+			}
+
+			if lines := strings.Count(logs.String(), "audit: "); lines != tc.expectedLines {
+				t.Fatalf("expected %d audit log lines, got %d: %q", tc.expectedLines, lines, logs.String())
+			}
+			if tc.expectedLines > 0 && !strings.Contains(logs.String(), fmt.Sprintf("method: %s, url: /audit, address: 192.0.2.1:1234, status: 201", tc.method)) {
+				t.Errorf("expected audit log line for the request, got %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestMirror(t *testing.T) {
+	mirrored := make(chan *http.Request, 1)
+	mirroredBodies := make(chan string, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- r
+		mirroredBodies <- string(body)
+	}))
+	defer target.Close()
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	handler := func(mirrorURL string) http.Handler {
+		return mirror(mirrorURL)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+			w.Write(body)
+		}))
+	}
+
+	t.Run("mirror request", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/mirror?foo=bar", strings.NewReader("test"))
+		req.Header.Set("X-Foo", "bar")
+
+		rec := httptest.NewRecorder()
+		handler(target.URL).ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusCreated || rec.Body.String() != "test" {
+			t.Errorf("expected status code 201 and body %q, got %d and %q", "test", rec.Code, rec.Body.String())
+		}
+
+		select {
+		case r := <-mirrored:
+			if r.Method != http.MethodPost || r.Header.Get("X-Mirror-Method") != http.MethodPut || r.Header.Get("X-Mirror-Source") != "/mirror?foo=bar" || r.Header.Get("X-Foo") != "bar" {
+				t.Errorf("unexpected mirrored request: method %s, headers %v", r.Method, r.Header)
+			}
+			if body := <-mirroredBodies; body != "test" {
+				t.Errorf("expected mirrored body %q, got %q", "test", body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected request to be mirrored")
+		}
+	})
+
+	t.Run("skip mirrored request", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("test"))
+		req.Header.Set("X-Mirror-Source", "/")
+
+		rec := httptest.NewRecorder()
+		handler(target.URL).ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusCreated || rec.Body.String() != "test" {
+			t.Errorf("expected status code 201 and body %q, got %d and %q", "test", rec.Code, rec.Body.String())
+		}
+
+		select {
+		case r := <-mirrored:
+			<-mirroredBodies
+			t.Errorf("expected request not to be mirrored, got mirrored request for %s", r.Header.Get("X-Mirror-Source"))
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("unreachable mirror target", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler(unreachable.URL).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader("test")))
+
+		if rec.Code != http.StatusCreated || rec.Body.String() != "test" {
+			t.Errorf("expected status code 201 and body %q, got %d and %q", "test", rec.Code, rec.Body.String())
+		}
+	})
+}
@@ -0,0 +1,489 @@
+//go:build ignore
+
+// This program generates the openapi.json and openapi.yaml files, which are
+// served by the echoserver. It can be invoked by running "go generate".
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type object = map[string]any
+
+func queryParameter(name, description string, required bool, example any) object {
+	schemaType := "string"
+	switch example.(type) {
+	case int:
+		schemaType = "integer"
+	}
+
+	return object{
+		"name":        name,
+		"in":          "query",
+		"description": description,
+		"required":    required,
+		"schema":      object{"type": schemaType},
+		"example":     example,
+	}
+}
+
+func response(description, contentType string, schema object) object {
+	if contentType == "" {
+		return object{"description": description}
+	}
+
+	return object{
+		"description": description,
+		"content": object{
+			contentType: object{"schema": schema},
+		},
+	}
+}
+
+func operation(summary string, parameters []any, responses object) object {
+	op := object{
+		"summary":   summary,
+		"responses": responses,
+	}
+	if len(parameters) > 0 {
+		op["parameters"] = parameters
+	}
+
+	return op
+}
+
+var (
+	plainKey = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+	textSchema  = object{"type": "string"}
+	errorResult = response("Invalid parameter", "text/plain", textSchema)
+)
+
+func spec() object {
+	echo := operation("Dump the HTTP request", []any{
+		object{
+			"name":        "addHeader",
+			"in":          "query",
+			"description": "Header in the format name:value, which should be added to the response. The parameter can be set multiple times.",
+			"required":    false,
+			"schema":      object{"type": "array", "items": textSchema},
+			"example":     []any{"X-Foo:bar"},
+		},
+	}, object{
+		"200": response("The dumped HTTP request", "text/plain", textSchema),
+		"400": errorResult,
+	})
+
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":       "echoserver",
+			"description": "Simple echoserver, which dumps HTTP requests.",
+			"version":     "1.0.0",
+		},
+		"paths": object{
+			"/": object{
+				"get":  echo,
+				"post": echo,
+			},
+			"/health": object{
+				"get": operation("Return a 200 status code", nil, object{
+					"200": response("The server is healthy", "text/plain", object{"type": "string", "example": "OK"}),
+					"503": response("The server is draining", "text/plain", textSchema),
+				}),
+			},
+			"/status": object{
+				"get": operation("Return a random or the defined status code", []any{
+					queryParameter("status", "The status code which should be returned or \"random\" for a random status code", false, "random"),
+				}, object{
+					"default": response("The requested status code", "", nil),
+				}),
+			},
+			"/timeout": object{
+				"get": operation("Wait the given amount of time before returning a 200 status code", []any{
+					queryParameter("timeout", "The duration to wait", true, "10s"),
+				}, object{
+					"200": response("The timeout expired", "", nil),
+					"400": errorResult,
+					"408": response("The request deadline was exceeded before the timeout expired", "text/plain", textSchema),
+					"503": response("The server was shut down before the timeout expired", "text/plain", textSchema),
+				}),
+			},
+			"/headersize": object{
+				"get": operation("Return a X-Header-Size header with the defined size", []any{
+					queryParameter("size", "The size of the header value", true, 1024),
+				}, object{
+					"200": object{
+						"description": "The response with the header",
+						"headers": object{
+							"X-Header-Size": object{"schema": textSchema},
+						},
+					},
+					"400": errorResult,
+				}),
+			},
+			"/bodysize": object{
+				"get": operation("Return a body of the defined size and type", []any{
+					queryParameter("size", "The size of the body", true, 1024),
+					queryParameter("type", "The type of the body (binary, text, json or image/png)", false, "binary"),
+				}, object{
+					"200": object{
+						"description": "The body",
+						"content": object{
+							"application/octet-stream": object{"schema": object{"type": "string", "format": "binary"}},
+							"text/plain":               object{"schema": textSchema},
+							"application/json":         object{"schema": object{"type": "array", "items": object{"type": "object"}}},
+							"image/png":                object{"schema": object{"type": "string", "format": "binary"}},
+						},
+					},
+					"400": errorResult,
+				}),
+			},
+			"/stream": object{
+				"get": operation("Stream JSON objects with a random payload", []any{
+					queryParameter("chunks", "The number of JSON objects", false, 10),
+					queryParameter("delay", "The delay between two JSON objects", false, "100ms"),
+					queryParameter("size", "The size of the random payload of each JSON object, which must not be larger than 1MB", false, 512),
+				}, object{
+					"200": response("The stream of newline delimited JSON objects", "application/json", object{
+						"type": "object",
+						"properties": object{
+							"sequence":  object{"type": "integer"},
+							"timestamp": object{"type": "string", "format": "date-time"},
+							"payload":   object{"type": "string"},
+						},
+					}),
+					"400": errorResult,
+				}),
+			},
+			"/redirect": object{
+				"get": operation("Redirect to the given url", []any{
+					queryParameter("url", "The absolute url to redirect to", true, "https://example.com"),
+					queryParameter("code", "The 3xx status code used for the redirect", false, 302),
+				}, object{
+					"3XX": object{
+						"description": "The redirect",
+						"headers": object{
+							"Location": object{"schema": textSchema},
+						},
+					},
+					"400": errorResult,
+				}),
+			},
+			"/push": object{
+				"get": operation("Return a Link header for the /health and /openapi.json resources, so that clients can preload them", nil, object{
+					"200": object{
+						"description": "The response, which contains a Link header for each resource",
+						"headers": object{
+							"Link": object{"schema": textSchema},
+						},
+						"content": object{
+							"text/plain": object{"schema": textSchema},
+						},
+					},
+				}),
+			},
+			"/fingerprint": object{
+				"get": operation("Return a SHA-256 fingerprint of the normalized request", []any{
+					queryParameter("include", "Comma-separated list of the request properties used for the fingerprint (headers, method, path, body)", false, "headers,method,path"),
+				}, object{
+					"200": response("The fingerprint and the values of the used request properties", "application/json", object{
+						"type": "object",
+						"properties": object{
+							"fingerprint": object{"type": "string"},
+							"components": object{
+								"type":                 "object",
+								"additionalProperties": object{"type": "string"},
+							},
+						},
+					}),
+					"400": errorResult,
+					"413": response("The body is larger than 32MB", "text/plain", textSchema),
+				}),
+			},
+			"/multipart": object{
+				"post": object{
+					"summary": "Return the fields and files of a multipart/form-data body",
+					"requestBody": object{
+						"content": object{
+							"multipart/form-data": object{"schema": object{"type": "object"}},
+						},
+					},
+					"responses": object{
+						"200": response("The fields and files of the body", "application/json", object{
+							"type": "object",
+							"properties": object{
+								"fields": object{
+									"type": "array",
+									"items": object{
+										"type": "object",
+										"properties": object{
+											"name":  object{"type": "string"},
+											"value": object{"type": "string"},
+										},
+									},
+								},
+								"files": object{
+									"type": "array",
+									"items": object{
+										"type": "object",
+										"properties": object{
+											"name":        object{"type": "string"},
+											"filename":    object{"type": "string"},
+											"contentType": object{"type": "string"},
+											"size":        object{"type": "integer"},
+										},
+									},
+								},
+							},
+						}),
+						"400": errorResult,
+						"413": response("The body is larger than 32MB", "text/plain", textSchema),
+					},
+				},
+			},
+			"/trailer": object{
+				"get": operation("Return a body with a CRC32 checksum in the X-Checksum trailer", []any{
+					queryParameter("size", "The size of the body", false, 1024),
+				}, object{
+					"200": response("The body, followed by the X-Checksum trailer", "text/plain", textSchema),
+					"400": errorResult,
+				}),
+			},
+			"/hijack": object{
+				"get": operation("Hijack the connection and write a raw HTTP/1.0 response", []any{
+					queryParameter("response", "The body of the raw response", false, "Hijacked"),
+				}, object{
+					"200": object{
+						"description": "The raw response, after which the connection is closed",
+						"headers": object{
+							"X-Hijacked": object{"schema": textSchema},
+						},
+						"content": object{
+							"text/plain": object{"schema": textSchema},
+						},
+					},
+				}),
+			},
+			"/p99": object{
+				"get": operation("Wait a random amount of time, which follows the given latency distribution, before returning a 200 status code", []any{
+					queryParameter("p50", "The 50th percentile of the latency", false, "10ms"),
+					queryParameter("p90", "The 90th percentile of the latency", false, "50ms"),
+					queryParameter("p99", "The 99th percentile of the latency", false, "200ms"),
+					queryParameter("p999", "The 99.9th percentile of the latency", false, "2s"),
+				}, object{
+					"200": object{
+						"description": "The simulated latency expired",
+						"headers": object{
+							"X-Simulated-Latency": object{"schema": textSchema},
+						},
+					},
+					"400": errorResult,
+					"408": response("The request deadline was exceeded before the simulated latency expired", "text/plain", textSchema),
+					"503": response("The server was shut down before the simulated latency expired", "text/plain", textSchema),
+				}),
+			},
+			"/longpoll": object{
+				"get": operation("Wait until a message is published to the topic or the timeout expires", []any{
+					queryParameter("topic", "The topic to subscribe to", false, "default"),
+					queryParameter("timeout", "The maximum duration to wait for a message", false, "20s"),
+				}, object{
+					"200": response("The published message", "application/octet-stream", object{"type": "string", "format": "binary"}),
+					"204": response("The timeout expired before a message was published", "", nil),
+					"400": errorResult,
+					"503": response("The server was shut down before a message was published", "text/plain", textSchema),
+				}),
+			},
+			"/longpoll/publish": object{
+				"post": object{
+					"summary": "Publish the body as message to all subscribers of the topic",
+					"parameters": []any{
+						queryParameter("topic", "The topic to publish the message to", false, "default"),
+					},
+					"requestBody": object{
+						"content": object{
+							"application/octet-stream": object{"schema": object{"type": "string", "format": "binary"}},
+						},
+					},
+					"responses": object{
+						"200": response("The number of subscribers, which received the message", "application/json", object{
+							"type": "object",
+							"properties": object{
+								"subscribers": object{"type": "integer"},
+							},
+						}),
+						"413": response("The body is larger than 1MB", "text/plain", textSchema),
+					},
+				},
+			},
+			"/env": object{
+				"get": operation("Return the environment variables, when ENABLE_ENV_HANDLER=true is set", []any{
+					queryParameter("prefix", "Only return environment variables with the given prefix", false, "MY_APP_"),
+					queryParameter("redact", "Comma-separated substrings of environment variable names, which values should be redacted", false, "SECRET,TOKEN,KEY"),
+				}, object{
+					"200": response("The environment variables", "application/json", object{
+						"type": "array",
+						"items": object{
+							"type": "object",
+							"properties": object{
+								"name":  object{"type": "string"},
+								"value": object{"type": "string"},
+							},
+						},
+					}),
+				}),
+			},
+			"/debug/goroutines": object{
+				"get": operation("Return the stacks of all goroutines, when ENABLE_DEBUG_GOROUTINES=true is set", []any{
+					queryParameter("min", "Only return goroutines, where at least the given number of goroutines are running the same top function", false, 2),
+					queryParameter("filter", "Only return goroutines, where the stack contains the given string", false, "net/http"),
+				}, object{
+					"200": response("The goroutines", "application/json", object{
+						"type": "object",
+						"properties": object{
+							"count": object{"type": "integer"},
+							"goroutines": object{
+								"type": "array",
+								"items": object{
+									"type": "object",
+									"properties": object{
+										"id":       object{"type": "integer"},
+										"state":    object{"type": "string"},
+										"function": object{"type": "string"},
+										"stack":    object{"type": "string"},
+									},
+								},
+							},
+						},
+					}),
+					"400": errorResult,
+				}),
+			},
+			"/debug/recordings": object{
+				"get": operation("Return the recorded requests and responses, when ENABLE_RECORDINGS=true is set", nil, object{
+					"200": response("The recorded requests and responses, ordered from the newest to the oldest one", "application/json", object{
+						"type": "array",
+						"items": object{
+							"type": "object",
+							"properties": object{
+								"timestamp":       object{"type": "string", "format": "date-time"},
+								"correlationId":   object{"type": "string"},
+								"method":          object{"type": "string"},
+								"path":            object{"type": "string"},
+								"requestHeaders":  object{"type": "object"},
+								"requestBody":     object{"type": "string"},
+								"statusCode":      object{"type": "integer"},
+								"responseHeaders": object{"type": "object"},
+								"responseBody":    object{"type": "string"},
+								"duration":        object{"type": "string"},
+							},
+						},
+					}),
+				}),
+				"delete": operation("Delete all recorded requests and responses, when ENABLE_RECORDINGS=true is set", nil, object{
+					"204": response("The recordings were deleted", "", nil),
+				}),
+			},
+		},
+	}
+}
+
+// writeYAML writes the given value as YAML. Since the value was decoded from
+// JSON, it can only contain objects, arrays, strings, numbers, booleans and
+// nil. Strings are written as JSON strings, which are valid YAML.
+func writeYAML(buf *bytes.Buffer, value any, indent int) {
+	prefix := strings.Repeat("  ", indent)
+
+	switch v := value.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			writeYAMLEntry(buf, prefix+yamlKey(key)+":", v[key], indent)
+		}
+	case []any:
+		for _, item := range v {
+			// Objects in an array are started on the same line as the dash,
+			// which has the same width as the indentation of the object.
+			if m, ok := item.(map[string]any); ok && len(m) > 0 {
+				var itemBuf bytes.Buffer
+				writeYAML(&itemBuf, m, indent+1)
+				buf.WriteString(prefix + "- ")
+				buf.Write(itemBuf.Bytes()[len(prefix)+2:])
+				continue
+			}
+			writeYAMLEntry(buf, prefix+"-", item, indent)
+		}
+	}
+}
+
+// yamlKey returns the key as plain YAML scalar, when this is possible without
+// changing its meaning. Otherwise the key is quoted.
+func yamlKey(key string) string {
+	if plainKey.MatchString(key) {
+		switch strings.ToLower(key) {
+		case "true", "false", "yes", "no", "on", "off", "null":
+		default:
+			return key
+		}
+	}
+
+	k, _ := json.Marshal(key)
+	return string(k)
+}
+
+func writeYAMLEntry(buf *bytes.Buffer, key string, value any, indent int) {
+	switch v := value.(type) {
+	case map[string]any:
+		if len(v) == 0 {
+			fmt.Fprintf(buf, "%s {}\n", key)
+			return
+		}
+		fmt.Fprintf(buf, "%s\n", key)
+		writeYAML(buf, v, indent+1)
+	case []any:
+		if len(v) == 0 {
+			fmt.Fprintf(buf, "%s []\n", key)
+			return
+		}
+		fmt.Fprintf(buf, "%s\n", key)
+		writeYAML(buf, v, indent+1)
+	default:
+		scalar, _ := json.Marshal(v)
+		fmt.Fprintf(buf, "%s %s\n", key, scalar)
+	}
+}
+
+func main() {
+	data, err := json.MarshalIndent(spec(), "", "  ")
+	if err != nil {
+		log.Fatalf("Could not marshal specification: %s", err.Error())
+	}
+
+	if err := os.WriteFile("openapi.json", append(data, '\n'), 0644); err != nil {
+		log.Fatalf("Could not write openapi.json: %s", err.Error())
+	}
+
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		log.Fatalf("Could not unmarshal specification: %s", err.Error())
+	}
+
+	var buf bytes.Buffer
+	writeYAML(&buf, value, 0)
+
+	if err := os.WriteFile("openapi.yaml", buf.Bytes(), 0644); err != nil {
+		log.Fatalf("Could not write openapi.yaml: %s", err.Error())
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	recordingMaxBodySize = 64 << 10
+)
+
+var (
+	recordingRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Override-Status-Token"}
+)
+
+// recording is a single request / response pair recorded by the recordingStore.
+// The request and response bodies are truncated to 64KB.
+type recording struct {
+	Timestamp       time.Time   `json:"timestamp"`
+	CorrelationID   string      `json:"correlationId"`
+	Method          string      `json:"method"`
+	Path            string      `json:"path"`
+	RequestHeaders  http.Header `json:"requestHeaders"`
+	RequestBody     string      `json:"requestBody"`
+	StatusCode      int         `json:"statusCode"`
+	ResponseHeaders http.Header `json:"responseHeaders"`
+	ResponseBody    string      `json:"responseBody"`
+	Duration        string      `json:"duration"`
+}
+
+// redactHeaders returns a copy of the given headers, where the values of all
+// headers which could contain credentials are redacted.
+func redactHeaders(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range recordingRedactedHeaders {
+		if _, ok := redacted[name]; ok {
+			redacted[name] = []string{"[REDACTED]"}
+		}
+	}
+
+	return redacted
+}
+
+// recordingStore holds the last recorded request / response pairs in a ring
+// buffer.
+type recordingStore struct {
+	mu         sync.RWMutex
+	recordings []recording
+	next       int
+	maxEntries int
+}
+
+func newRecordingStore(maxEntries int) *recordingStore {
+	return &recordingStore{
+		recordings: make([]recording, 0, maxEntries),
+		maxEntries: maxEntries,
+	}
+}
+
+func (s *recordingStore) add(rec recording) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.recordings) < s.maxEntries {
+		s.recordings = append(s.recordings, rec)
+		return
+	}
+
+	s.recordings[s.next] = rec
+	s.next = (s.next + 1) % s.maxEntries
+}
+
+// list returns all recordings, ordered from the newest to the oldest one.
+func (s *recordingStore) list() []recording {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	recordings := make([]recording, 0, len(s.recordings))
+	for i := len(s.recordings) - 1; i >= 0; i-- {
+		recordings = append(recordings, s.recordings[(s.next+i)%len(s.recordings)])
+	}
+
+	return recordings
+}
+
+func (s *recordingStore) clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.recordings = s.recordings[:0]
+	s.next = 0
+}
+
+// recordingResponseWriter captures the status code and the first 64KB of the
+// body written by the handler.
+type recordingResponseWriter struct {
+	*responseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if remaining := recordingMaxBodySize - w.body.Len(); remaining > 0 {
+		w.body.Write(b[:min(len(b), remaining)])
+	}
+
+	return w.responseWriter.Write(b)
+}
+
+// record records all requests, except the requests for the recordings
+// endpoint, in the given store.
+func record(store *recordingStore) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/debug/recordings" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+
+			body, err := readBody(r, recordingMaxBodySize)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			requestHeaders := redactHeaders(r.Header)
+
+			rw := &recordingResponseWriter{responseWriter: newResponseWriter(w)}
+			next.ServeHTTP(rw, r)
+
+			store.add(recording{
+				Timestamp:       start,
+				CorrelationID:   getCorrelationID(r.Context()),
+				Method:          r.Method,
+				Path:            r.URL.Path,
+				RequestHeaders:  requestHeaders,
+				RequestBody:     string(body),
+				StatusCode:      rw.statusCode,
+				ResponseHeaders: redactHeaders(w.Header()),
+				ResponseBody:    rw.body.String(),
+				Duration:        time.Since(start).String(),
+			})
+		})
+	}
+}
+
+// recordingsHandler returns the recordings from the given store for GET
+// requests and clears the store for DELETE requests.
+func recordingsHandler(store *recordingStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(store.list())
+		case http.MethodDelete:
+			store.clear()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRecordingStore(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		maxEntries int
+		added      int
+		expected   []string
+	}{
+		{name: "empty", maxEntries: 3, added: 0, expected: []string{}},
+		{name: "not full", maxEntries: 3, added: 2, expected: []string{"/1", "/0"}},
+		{name: "full", maxEntries: 3, added: 3, expected: []string{"/2", "/1", "/0"}},
+		{name: "evict oldest", maxEntries: 3, added: 4, expected: []string{"/3", "/2", "/1"}},
+		{name: "wrap around", maxEntries: 3, added: 7, expected: []string{"/6", "/5", "/4"}},
+		{name: "single entry", maxEntries: 1, added: 5, expected: []string{"/4"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newRecordingStore(tc.maxEntries)
+			for i := 0; i < tc.added; i++ {
+				store.add(recording{Path: fmt.Sprintf("/%d", i)})
+			}
+
+			paths := []string{}
+			for _, rec := range store.list() {
+				paths = append(paths, rec.Path)
+			}
+
+			if strings.Join(paths, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("expected %v, got %v", tc.expected, paths)
+			}
+		})
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	header.Set("Cookie", "session=secret")
+	header.Set("X-Override-Status-Token", "secret")
+	header.Set("User-Agent", "test")
+
+	redacted := redactHeaders(header)
+
+	for _, name := range []string{"Authorization", "Cookie", "X-Override-Status-Token"} {
+		if value := redacted.Get(name); value != "[REDACTED]" {
+			t.Errorf("expected header %s to be redacted, got %q", name, value)
+		}
+	}
+	if value := redacted.Get("User-Agent"); value != "test" {
+		t.Errorf("expected header User-Agent to be kept, got %q", value)
+	}
+	if _, ok := redacted["Set-Cookie"]; ok {
+		t.Error("expected missing header Set-Cookie not to be added")
+	}
+	if value := header.Get("Authorization"); value != "Bearer secret" {
+		t.Errorf("expected original headers not to be modified, got %q", value)
+	}
+}